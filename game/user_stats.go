@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/zond/diplicity/auth"
@@ -17,16 +18,20 @@ import (
 
 const (
 	userStatsKind = "UserStats"
+
+	defaultUserStatsRecalcBatchSize = 100
 )
 
 var (
-	UpdateUserStatsFunc *DelayFunc
-	updateUserStatFunc  *DelayFunc
+	UpdateUserStatsFunc         *DelayFunc
+	updateUserStatFunc          *DelayFunc
+	RecalculateAllUserStatsFunc *DelayFunc
 )
 
 func init() {
 	UpdateUserStatsFunc = NewDelayFunc("game-updateUserStats", updateUserStats)
 	updateUserStatFunc = NewDelayFunc("game-updateUserStat", updateUserStat)
+	RecalculateAllUserStatsFunc = NewDelayFunc("game-recalculateAllUserStats", recalculateAllUserStats)
 }
 
 func UpdateUserStatsASAP(ctx context.Context, uids []string) error {
@@ -36,9 +41,94 @@ func UpdateUserStatsASAP(ctx context.Context, uids []string) error {
 	return UpdateUserStatsFunc.EnqueueIn(ctx, time.Second*10, uids)
 }
 
+// RecalculateAllUserStatsASAP kicks off a full sweep of every `UserStats`
+// entity, batching the recalculation so that a nightly rebuild doesn't have
+// to enqueue one task per user up front.
+func RecalculateAllUserStatsASAP(ctx context.Context) error {
+	return RecalculateAllUserStatsFunc.EnqueueIn(ctx, 0, "", defaultUserStatsRecalcBatchSize)
+}
+
+// recalculateAllUserStats walks `UserStats` keys-only, a page at a time,
+// fans the found UIDs onto `UpdateUserStatsFunc`, and re-enqueues itself
+// with the next cursor until the query is exhausted. Each page is bounded by
+// an `appengine.Timeout` so a slow datastore doesn't eat into the task's
+// overall deadline.
+func recalculateAllUserStats(ctx context.Context, cursorString string, batchSize int) error {
+	log.Infof(ctx, "recalculateAllUserStats(..., %q, %v)", cursorString, batchSize)
+
+	if batchSize < 1 {
+		batchSize = defaultUserStatsRecalcBatchSize
+	}
+
+	ctx = appengine.Timeout(ctx, time.Minute)
+
+	query := datastore.NewQuery(userStatsKind).KeysOnly()
+	if cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			log.Errorf(ctx, "Unable to decode cursor %q: %v; hope the cursor gets fixed", cursorString, err)
+			return err
+		}
+		query = query.Start(cursor)
+	}
+	query = query.Limit(batchSize)
+
+	uids := []string{}
+	it := query.Run(ctx)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			log.Errorf(ctx, "Unable to iterate user stats keys: %v; hope datastore gets fixed", err)
+			return err
+		}
+		uids = append(uids, key.StringID())
+	}
+
+	nextCursor, err := it.Cursor()
+	if err != nil {
+		log.Errorf(ctx, "Unable to get next cursor: %v; hope datastore gets fixed", err)
+		return err
+	}
+
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if len(uids) > 0 {
+			if err := UpdateUserStatsFunc.EnqueueIn(ctx, 0, uids); err != nil {
+				log.Errorf(ctx, "Unable to enqueue updating batch: %v; hope datastore gets fixed", err)
+				return err
+			}
+		}
+		if len(uids) == batchSize {
+			if err := RecalculateAllUserStatsFunc.EnqueueIn(ctx, 0, nextCursor.String(), batchSize); err != nil {
+				log.Errorf(ctx, "Unable to enqueue continuation: %v; hope datastore gets fixed", err)
+				return err
+			}
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		log.Errorf(ctx, "Unable to commit recalculate tx: %v", err)
+		return err
+	}
+
+	log.Infof(ctx, "recalculateAllUserStats(..., %q, %v) *** SUCCESS ***", cursorString, batchSize)
+
+	return nil
+}
+
 func updateUserStat(ctx context.Context, userId string) error {
 	log.Infof(ctx, "updateUserStat(..., %q)", userId)
 
+	previousStats := &UserStats{}
+	hadPreviousStats := true
+	if err := datastore.Get(ctx, UserStatsID(ctx, userId), previousStats); err == datastore.ErrNoSuchEntity {
+		hadPreviousStats = false
+	} else if err != nil {
+		log.Errorf(ctx, "Unable to load previous stats for %q: %v; hope datastore gets fixed", userId, err)
+		return err
+	}
+
 	userStats := &UserStats{
 		UserId: userId,
 	}
@@ -62,6 +152,16 @@ func updateUserStat(ctx context.Context, userId string) error {
 		log.Errorf(ctx, "Unable to store stats %v: %v; hope datastore gets fixed", userStats, err)
 		return err
 	}
+	if err := maybeSnapshotUserStats(ctx, userStats); err != nil {
+		log.Errorf(ctx, "Unable to snapshot stats %v: %v; hope datastore gets fixed", userStats, err)
+		return err
+	}
+	if !hadPreviousStats || previousStats.Glicko.Rating != userStats.Glicko.Rating {
+		if err := notifyStatsFollowers(ctx, userId); err != nil {
+			log.Errorf(ctx, "Unable to notify stats followers for %q: %v; hope datastore gets fixed", userId, err)
+			return err
+		}
+	}
 
 	log.Infof(ctx, "updateUserStat(..., %q) *** SUCCESS ***", userId)
 
@@ -136,10 +236,11 @@ type UserStats struct {
 	Reliability  float64
 	Quickness    float64
 
-	OwnedBans  int
-	SharedBans int
-	Hated      float64
-	Hater      float64
+	OwnedBans      int
+	SharedBans     int
+	Hated          float64
+	Hater          float64
+	BanClusterSize int
 
 	Glicko Glicko
 	User   auth.User
@@ -150,6 +251,132 @@ var UserStatsResource = &Resource{
 	FullPath: "/User/{user_id}/Stats",
 }
 
+const (
+	defaultUserStatsLeaderboardLimit = 50
+	maxUserStatsLeaderboardLimit     = 500
+)
+
+// userStatsLeaderboardMetrics maps the `metric` path variable accepted by
+// `UserStatsLeaderboardResource` to the `UserStats` property to order by.
+var userStatsLeaderboardMetrics = map[string]string{
+	"Glicko.Rating": "Glicko.Rating",
+	"Reliability":   "Reliability",
+	"Quickness":     "Quickness",
+	"SoloGames":     "SoloGames",
+	"FinishedGames": "FinishedGames",
+	"Hater":         "Hater",
+}
+
+var UserStatsLeaderboardResource = &Resource{
+	Load:     loadUserStatsLeaderboard,
+	FullPath: "/Users/Ranking/{metric}",
+}
+
+// userStatsLeaderboard wraps a ranked, cursor-paginated page of `UserStats`
+// so it can be rendered the same way `UserStatsSlice.Item` renders any other
+// stats list.
+type userStatsLeaderboard struct {
+	slice  UserStatsSlice
+	cursor *datastore.Cursor
+	limit  int64
+	metric string
+}
+
+func (l *userStatsLeaderboard) Item(r Request) *Item {
+	return l.slice.Item(r, l.cursor, l.limit, "user-stats-leaderboard", []string{
+		fmt.Sprintf("The top %s rankings, highest first.", l.metric),
+	}, "UserStatsLeaderboard")
+}
+
+func loadUserStatsLeaderboard(w ResponseWriter, r Request) (*userStatsLeaderboard, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	_, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	metric := r.Vars()["metric"]
+	property, ok := userStatsLeaderboardMetrics[metric]
+	if !ok {
+		return nil, HTTPErr{fmt.Sprintf("unknown metric %q", metric), 400}
+	}
+
+	limit := int64(defaultUserStatsLeaderboardLimit)
+	if limitParam := r.Req().URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.ParseInt(limitParam, 10, 64)
+		if err != nil {
+			return nil, HTTPErr{"limit must be an integer", 400}
+		}
+		limit = parsed
+	}
+	if limit < 1 {
+		limit = defaultUserStatsLeaderboardLimit
+	}
+	if limit > maxUserStatsLeaderboardLimit {
+		limit = maxUserStatsLeaderboardLimit
+	}
+
+	minFinished := int64(0)
+	if minFinishedParam := r.Req().URL.Query().Get("min_finished"); minFinishedParam != "" {
+		parsed, err := strconv.ParseInt(minFinishedParam, 10, 64)
+		if err != nil {
+			return nil, HTTPErr{"min_finished must be an integer", 400}
+		}
+		minFinished = parsed
+	}
+
+	// `min_finished` can't be applied as a datastore inequality filter
+	// alongside `Order("-" + property)` for any metric but `FinishedGames`
+	// itself: datastore requires a query with an inequality filter to order
+	// by that same property first, which would break every other ranking.
+	// Filter it in memory instead, and base the cursor decision on how many
+	// entities the underlying, unfiltered query actually returned rather
+	// than on how many survived the filter.
+	query := datastore.NewQuery(userStatsKind).Order("-" + property).Limit(int(limit))
+	if cursorParam := r.Req().URL.Query().Get("cursor"); cursorParam != "" {
+		cursor, err := datastore.DecodeCursor(cursorParam)
+		if err != nil {
+			return nil, HTTPErr{"cursor is malformed", 400}
+		}
+		query = query.Start(cursor)
+	}
+
+	result := UserStatsSlice{}
+	fetched := int64(0)
+	it := query.Run(ctx)
+	for {
+		userStats := UserStats{}
+		_, err := it.Next(&userStats)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		fetched++
+		if int64(userStats.FinishedGames) >= minFinished {
+			result = append(result, userStats)
+		}
+	}
+
+	var cursor *datastore.Cursor
+	if fetched == limit {
+		c, err := it.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		cursor = &c
+	}
+
+	return &userStatsLeaderboard{
+		slice:  result,
+		cursor: cursor,
+		limit:  limit,
+		metric: metric,
+	}, nil
+}
+
 func devUserStatsUpdate(w ResponseWriter, r Request) error {
 	ctx := appengine.NewContext(r.Req())
 
@@ -214,13 +441,7 @@ func (u *UserStats) Recalculate(ctx context.Context) error {
 		return err
 	}
 
-	if u.NMRPhases, err = datastore.NewQuery(phaseResultKind).Filter("NMRUsers=", u.UserId).Count(ctx); err != nil {
-		return err
-	}
-	if u.ActivePhases, err = datastore.NewQuery(phaseResultKind).Filter("ActiveUsers=", u.UserId).Count(ctx); err != nil {
-		return err
-	}
-	if u.ReadyPhases, err = datastore.NewQuery(phaseResultKind).Filter("ReadyUsers=", u.UserId).Count(ctx); err != nil {
+	if err := u.tallyPhaseResults(ctx); err != nil {
 		return err
 	}
 	u.Reliability = float64(u.ReadyPhases+u.ActivePhases) / float64(u.ReadyPhases+u.ActivePhases+u.NMRPhases+1)
@@ -234,6 +455,71 @@ func (u *UserStats) Recalculate(ctx context.Context) error {
 	}
 	u.Hater = float64(u.OwnedBans) / float64(u.StartedGames+1)
 	u.Hated = float64(u.SharedBans-u.OwnedBans) / float64(u.StartedGames+1)
+
+	clusterSize, err := computeBanClusterSize(ctx, u.UserId)
+	if err != nil {
+		return err
+	}
+	u.BanClusterSize = clusterSize
+
+	return nil
+}
+
+// phaseResultUserTally is a projection of the `phaseResultKind` fields
+// `Recalculate` needs to bucket a phase result against, loaded once per
+// phase instead of Count-ing each bucket separately. `CreatedAt` goes
+// unused by `Recalculate` itself, but lets `devUserStatsHistoryBackfill`
+// walk the same tally in chronological order.
+type phaseResultUserTally struct {
+	User        []string
+	NMRUsers    []string
+	ActiveUsers []string
+	ReadyUsers  []string
+	CreatedAt   time.Time
+}
+
+func stringSliceContains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketPhaseResultTally decides which of NMR/Active/Ready a loaded
+// `phaseResultUserTally` counts towards for `userId`, split out from
+// `tallyPhaseResults` so the bucketing rules are unit-testable without a
+// datastore.
+func bucketPhaseResultTally(tally *phaseResultUserTally, userId string) (nmr bool, active bool, ready bool) {
+	return stringSliceContains(tally.NMRUsers, userId), stringSliceContains(tally.ActiveUsers, userId), stringSliceContains(tally.ReadyUsers, userId)
+}
+
+// tallyPhaseResults scans `phaseResultKind` once for every phase the user
+// took part in and buckets it into NMR/Active/Ready in-memory, replacing
+// three separate `Count` round trips with a single query.
+func (u *UserStats) tallyPhaseResults(ctx context.Context) error {
+	it := datastore.NewQuery(phaseResultKind).Filter("User=", u.UserId).Run(ctx)
+	for {
+		tally := &phaseResultUserTally{}
+		_, err := it.Next(tally)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		nmr, active, ready := bucketPhaseResultTally(tally, u.UserId)
+		if nmr {
+			u.NMRPhases++
+		}
+		if active {
+			u.ActivePhases++
+		}
+		if ready {
+			u.ReadyPhases++
+		}
+	}
 	return nil
 }
 
@@ -243,4 +529,316 @@ func UserStatsID(ctx context.Context, userId string) *datastore.Key {
 
 func (u *UserStats) ID(ctx context.Context) *datastore.Key {
 	return UserStatsID(ctx, u.UserId)
-}
\ No newline at end of file
+}
+
+const (
+	userStatsSnapshotKind = "UserStatsSnapshot"
+
+	// userStatsSnapshotGlickoDelta is how far a user's Glicko rating has to
+	// move since today's snapshot before that snapshot is rewritten with the
+	// current values; snapshots are keyed per day, so this never adds a
+	// second snapshot for the same day.
+	userStatsSnapshotGlickoDelta = 15.0
+
+	userStatsSnapshotDateFormat = "20060102"
+)
+
+// UserStatsSnapshot is a point-in-time copy of the parts of `UserStats` that
+// are interesting to chart over time, keyed by `(UserId, Date)` so that
+// `updateUserStat` can upsert at most one snapshot per user per day.
+type UserStatsSnapshot struct {
+	UserId string
+	Date   string
+
+	At            time.Time
+	Glicko        Glicko
+	Reliability   float64
+	Quickness     float64
+	FinishedGames int
+}
+
+func UserStatsSnapshotID(ctx context.Context, userId string, date string) *datastore.Key {
+	return datastore.NewKey(ctx, userStatsSnapshotKind, userId+":"+date, 0, nil)
+}
+
+func (u *UserStatsSnapshot) ID(ctx context.Context) *datastore.Key {
+	return UserStatsSnapshotID(ctx, u.UserId, u.Date)
+}
+
+// shouldTakeUserStatsSnapshot decides whether `maybeSnapshotUserStats` should
+// write a new snapshot, split out so the threshold/cadence rule is
+// unit-testable without a datastore: take one if there isn't one yet, if
+// today doesn't have one, or if the rating has moved more than
+// `userStatsSnapshotGlickoDelta` since today's.
+func shouldTakeUserStatsSnapshot(hasLast bool, last *UserStatsSnapshot, today string, currentRating float64) bool {
+	if !hasLast || last.Date != today {
+		return true
+	}
+	delta := currentRating - last.Glicko.Rating
+	if delta < 0 {
+		delta = -delta
+	}
+	return delta > userStatsSnapshotGlickoDelta
+}
+
+// maybeSnapshotUserStats writes a `UserStatsSnapshot` for `userStats` unless
+// one was already written today and the Glicko rating hasn't moved more than
+// `userStatsSnapshotGlickoDelta` since then.
+func maybeSnapshotUserStats(ctx context.Context, userStats *UserStats) error {
+	today := time.Now().Format(userStatsSnapshotDateFormat)
+
+	last := &UserStatsSnapshot{}
+	it := datastore.NewQuery(userStatsSnapshotKind).Filter("UserId=", userStats.UserId).Order("-Date").Limit(1).Run(ctx)
+	_, err := it.Next(last)
+	hasLast := true
+	if err == datastore.Done {
+		hasLast = false
+	} else if err != nil {
+		return err
+	}
+
+	if !shouldTakeUserStatsSnapshot(hasLast, last, today, userStats.Glicko.Rating) {
+		return nil
+	}
+
+	snapshot := &UserStatsSnapshot{
+		UserId:        userStats.UserId,
+		Date:          today,
+		At:            time.Now(),
+		Glicko:        userStats.Glicko,
+		Reliability:   userStats.Reliability,
+		Quickness:     userStats.Quickness,
+		FinishedGames: userStats.FinishedGames,
+	}
+	_, err = datastore.Put(ctx, snapshot.ID(ctx), snapshot)
+	return err
+}
+
+// UserStatsHistoryPoint is a single charted sample of a user's stats.
+type UserStatsHistoryPoint struct {
+	At            time.Time
+	Glicko        Glicko
+	Reliability   float64
+	Quickness     float64
+	FinishedGames int
+}
+
+type UserStatsHistorySlice []UserStatsHistoryPoint
+
+func (s UserStatsHistorySlice) Item(r Request, cursor *datastore.Cursor, limit int64, name string, desc []string, route string) *Item {
+	pointItems := make(List, len(s))
+	for i := range s {
+		pointItems[i] = NewItem(s[i]).SetName("user-stats-history-point")
+	}
+	pointsItem := NewItem(pointItems).SetName(name).SetDesc([][]string{
+		desc,
+	}).AddLink(r.NewLink(Link{
+		Rel:   "self",
+		Route: route,
+	}))
+	if cursor != nil {
+		pointsItem.AddLink(r.NewLink(Link{
+			Rel:   "next",
+			Route: route,
+			QueryParams: url.Values{
+				"cursor": []string{cursor.String()},
+				"limit":  []string{fmt.Sprint(limit)},
+			},
+		}))
+	}
+	return pointsItem
+}
+
+var UserStatsHistoryResource = &Resource{
+	Load:     loadUserStatsHistory,
+	FullPath: "/User/{user_id}/Stats/History",
+}
+
+type userStatsHistory struct {
+	slice  UserStatsHistorySlice
+	cursor *datastore.Cursor
+	limit  int64
+}
+
+func (h *userStatsHistory) Item(r Request) *Item {
+	return h.slice.Item(r, h.cursor, h.limit, "user-stats-history", []string{
+		"The Glicko/Reliability/Quickness/FinishedGames trend for this user, oldest first.",
+	}, "UserStatsHistory")
+}
+
+func loadUserStatsHistory(w ResponseWriter, r Request) (*userStatsHistory, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	_, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	limit := int64(defaultUserStatsLeaderboardLimit)
+	if limitParam := r.Req().URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.ParseInt(limitParam, 10, 64)
+		if err != nil {
+			return nil, HTTPErr{"limit must be an integer", 400}
+		}
+		limit = parsed
+	}
+	if limit < 1 {
+		limit = defaultUserStatsLeaderboardLimit
+	}
+	if limit > maxUserStatsLeaderboardLimit {
+		limit = maxUserStatsLeaderboardLimit
+	}
+
+	query := datastore.NewQuery(userStatsSnapshotKind).Filter("UserId=", r.Vars()["user_id"]).Order("Date").Limit(int(limit))
+	if from := r.Req().URL.Query().Get("from"); from != "" {
+		query = query.Filter("Date>=", from)
+	}
+	if to := r.Req().URL.Query().Get("to"); to != "" {
+		query = query.Filter("Date<=", to)
+	}
+	if cursorParam := r.Req().URL.Query().Get("cursor"); cursorParam != "" {
+		cursor, err := datastore.DecodeCursor(cursorParam)
+		if err != nil {
+			return nil, HTTPErr{"cursor is malformed", 400}
+		}
+		query = query.Start(cursor)
+	}
+
+	points := UserStatsHistorySlice{}
+	it := query.Run(ctx)
+	for {
+		snapshot := UserStatsSnapshot{}
+		_, err := it.Next(&snapshot)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, UserStatsHistoryPoint{
+			At:            snapshot.At,
+			Glicko:        snapshot.Glicko,
+			Reliability:   snapshot.Reliability,
+			Quickness:     snapshot.Quickness,
+			FinishedGames: snapshot.FinishedGames,
+		})
+	}
+
+	var cursor *datastore.Cursor
+	if int64(len(points)) == limit {
+		c, err := it.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		cursor = &c
+	}
+
+	return &userStatsHistory{
+		slice:  points,
+		cursor: cursor,
+		limit:  limit,
+	}, nil
+}
+
+// gameCreatedAtProjection lets the backfill walk read only the `CreatedAt`
+// field off `gameKind` entities instead of decoding the whole game.
+type gameCreatedAtProjection struct {
+	CreatedAt time.Time
+}
+
+// devUserStatsHistoryBackfill synthesizes `UserStatsSnapshot` entities for
+// every existing `UserStats` from the user's `phaseResultKind`/`gameKind`
+// history, for local dev servers that never had a chance to accumulate real
+// snapshots. Reliability/Quickness are reconstructed exactly, by replaying
+// `phaseResultKind` in chronological order through the same bucketing
+// `Recalculate` uses; FinishedGames still comes from `gameKind`, since
+// `gameResultKind` only records *which* bucket a finished game's outcome
+// fell into for a user (`SoloWinnerUser`/`DIASUsers`/`EliminatedUsers`/
+// `NMRUsers`), not a general "this user's game finished" membership to
+// query against - `gameKind`'s `Finished` flag is what `Recalculate` itself
+// trusts for that count. Glicko can't be reconstructed at all, since no
+// kind records the rating as it stood at each point in time, so every
+// synthesized point carries the user's current rating.
+func devUserStatsHistoryBackfill(w ResponseWriter, r Request) error {
+	ctx := appengine.NewContext(r.Req())
+
+	if !appengine.IsDevAppServer() {
+		return fmt.Errorf("only accessible in local dev mode")
+	}
+
+	keysIt := datastore.NewQuery(userStatsKind).KeysOnly().Run(ctx)
+	for {
+		key, err := keysIt.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		userId := key.StringID()
+
+		userStats := &UserStats{}
+		if err := datastore.Get(ctx, key, userStats); err != nil {
+			return err
+		}
+
+		phases := []*phaseResultUserTally{}
+		phasesIt := datastore.NewQuery(phaseResultKind).Filter("User=", userId).Order("CreatedAt").Run(ctx)
+		for {
+			tally := &phaseResultUserTally{}
+			_, err := phasesIt.Next(tally)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			phases = append(phases, tally)
+		}
+
+		nmrPhases, activePhases, readyPhases := 0, 0, 0
+		phaseIdx := 0
+		finishedGames := 0
+		gamesIt := datastore.NewQuery(gameKind).Filter("Members.User.Id=", userId).Filter("Finished=", true).Order("CreatedAt").Project("CreatedAt").Run(ctx)
+		for {
+			game := &gameCreatedAtProjection{}
+			_, err := gamesIt.Next(game)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			finishedGames++
+
+			for phaseIdx < len(phases) && !phases[phaseIdx].CreatedAt.After(game.CreatedAt) {
+				nmr, active, ready := bucketPhaseResultTally(phases[phaseIdx], userId)
+				if nmr {
+					nmrPhases++
+				}
+				if active {
+					activePhases++
+				}
+				if ready {
+					readyPhases++
+				}
+				phaseIdx++
+			}
+
+			snapshot := &UserStatsSnapshot{
+				UserId:        userId,
+				Date:          game.CreatedAt.Format(userStatsSnapshotDateFormat),
+				At:            game.CreatedAt,
+				Glicko:        userStats.Glicko,
+				Reliability:   float64(readyPhases+activePhases) / float64(readyPhases+activePhases+nmrPhases+1),
+				Quickness:     float64(readyPhases) / float64(readyPhases+activePhases+nmrPhases+1),
+				FinishedGames: finishedGames,
+			}
+			if _, err := datastore.Put(ctx, snapshot.ID(ctx), snapshot); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
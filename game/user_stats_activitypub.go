@@ -0,0 +1,348 @@
+package game
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/writeas/httpsig"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	statsFollowerKind = "StatsFollower"
+
+	activityStreamsContentType = "application/activity+json"
+)
+
+var (
+	deliverStatsUpdateActivityFunc *DelayFunc
+)
+
+func init() {
+	deliverStatsUpdateActivityFunc = NewDelayFunc("game-deliverStatsUpdateActivity", deliverStatsUpdateActivity)
+}
+
+// StatsFollower records that `FollowerActorID` asked to follow `UserId`'s
+// stats actor, so that `updateUserStat` knows where to deliver `Update`
+// activities when the user's Glicko changes.
+type StatsFollower struct {
+	UserId          string
+	FollowerActorID string
+	SharedInbox     string
+	CreatedAt       time.Time
+}
+
+func statsFollowerID(ctx context.Context, userId string, followerActorID string) *datastore.Key {
+	return datastore.NewKey(ctx, statsFollowerKind, userId+":"+followerActorID, 0, nil)
+}
+
+func (f *StatsFollower) Item(r Request) *Item {
+	return NewItem(f).SetName("stats-follower").AddLink(r.NewLink(UserStatsInboxResource.Link("create", Create, []string{"user_id", f.UserId})))
+}
+
+var UserStatsActorResource = &Resource{
+	Load:     loadUserStatsActor,
+	FullPath: "/User/{user_id}/Actor",
+}
+
+var UserStatsInboxResource = &Resource{
+	Create:   createUserStatsInboxActivity,
+	FullPath: "/User/{user_id}/Inbox",
+}
+
+// activityStreamsPerson is the ActivityStreams `Person` document rendered
+// for a user's stats actor, readable by Mastodon-compatible clients.
+type activityStreamsPerson struct {
+	Context           []string                  `json:"@context"`
+	ID                string                    `json:"id"`
+	Type              string                    `json:"type"`
+	PreferredUsername string                    `json:"preferredUsername"`
+	Summary           string                    `json:"summary"`
+	Inbox             string                    `json:"inbox"`
+	Attachment        []activityStreamsProperty `json:"attachment"`
+}
+
+// schemeFor recovers the scheme the client actually used. App Engine
+// terminates TLS at the load balancer, so `r.Req().TLS` is always nil for
+// the request this code sees even when the public request was HTTPS;
+// `X-Forwarded-Proto` carries what the load balancer saw instead.
+func schemeFor(r Request) string {
+	if proto := r.Req().Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	if r.Req().TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+type activityStreamsProperty struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// loadUserStatsActor renders the same `UserStats` that `loadUserStats`
+// loads, but as an ActivityStreams `Person` document instead of a plain
+// `goaeoas` item.
+func loadUserStatsActor(w ResponseWriter, r Request) (*UserStats, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	userId := r.Vars()["user_id"]
+
+	userStats := &UserStats{}
+	if err := datastore.Get(ctx, UserStatsID(ctx, userId), userStats); err == datastore.ErrNoSuchEntity {
+		userStats.UserId = userId
+	} else if err != nil {
+		return nil, err
+	}
+	userStats.User.Email = ""
+
+	w.Header().Set("Content-Type", activityStreamsContentType)
+
+	base := fmt.Sprintf("%s://%s", schemeFor(r), r.Req().Host)
+	person := &activityStreamsPerson{
+		Context:           []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"},
+		ID:                fmt.Sprintf("%s/User/%s/Actor", base, userId),
+		Type:              "Person",
+		PreferredUsername: userStats.User.Name,
+		Summary:           fmt.Sprintf("%d started, %d finished, %d solo wins.", userStats.StartedGames, userStats.FinishedGames, userStats.SoloGames),
+		Inbox:             fmt.Sprintf("%s/User/%s/Inbox", base, userId),
+		Attachment: []activityStreamsProperty{
+			{Type: "PropertyValue", Name: "Glicko Rating", Value: fmt.Sprintf("%.0f", userStats.Glicko.Rating)},
+			{Type: "PropertyValue", Name: "Reliability", Value: fmt.Sprintf("%.2f", userStats.Reliability)},
+			{Type: "PropertyValue", Name: "Quickness", Value: fmt.Sprintf("%.2f", userStats.Quickness)},
+		},
+	}
+
+	if err := json.NewEncoder(w).Encode(person); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// activityStreamsFollow is the subset of an ActivityStreams `Follow`
+// activity the inbox needs to record a follower.
+type activityStreamsFollow struct {
+	Type   string `json:"type"`
+	Actor  string `json:"actor"`
+	Object string `json:"object"`
+}
+
+// activityStreamsActor is the subset of a remote actor document the inbox
+// needs to verify HTTP signatures and find the shared inbox to deliver to.
+type activityStreamsActor struct {
+	ID          string `json:"id"`
+	SharedInbox struct {
+		HRef string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		ID           string `json:"id"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+// createUserStatsInboxActivity accepts `Follow` activities delivered to a
+// user's stats actor inbox, verifying the HTTP signature against the
+// sender's published public key before recording them as a `StatsFollower`.
+func createUserStatsInboxActivity(w ResponseWriter, r Request) (*StatsFollower, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	body, err := ioutil.ReadAll(r.Req().Body)
+	if err != nil {
+		return nil, err
+	}
+
+	activity := &activityStreamsFollow{}
+	if err := json.Unmarshal(body, activity); err != nil {
+		return nil, HTTPErr{"malformed activity", 400}
+	}
+	if activity.Type != "Follow" {
+		return nil, HTTPErr{"only Follow activities are accepted", 400}
+	}
+
+	actor, err := verifyActivityRequestSignature(ctx, r, activity.Actor)
+	if err != nil {
+		log.Warningf(ctx, "Unable to verify signature for %q: %v", activity.Actor, err)
+		return nil, HTTPErr{"invalid HTTP signature", 401}
+	}
+
+	follower := &StatsFollower{
+		UserId:          r.Vars()["user_id"],
+		FollowerActorID: actor.ID,
+		SharedInbox:     actor.SharedInbox.HRef,
+		CreatedAt:       time.Now(),
+	}
+	if _, err := datastore.Put(ctx, statsFollowerID(ctx, follower.UserId, follower.FollowerActorID), follower); err != nil {
+		return nil, err
+	}
+
+	return follower, nil
+}
+
+// verifyActivityRequestSignature fetches the claimed actor document and
+// verifies the inbound request's HTTP signature against its published
+// public key, per the `writeas/httpsig` verification flow.
+func verifyActivityRequestSignature(ctx context.Context, r Request, actorID string) (*activityStreamsActor, error) {
+	verifier, err := httpsig.NewVerifier(r.Req())
+	if err != nil {
+		return nil, err
+	}
+
+	actor, err := fetchActivityStreamsActor(ctx, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if verifier.KeyId() != actor.PublicKey.ID {
+		return nil, fmt.Errorf("signature key id %q does not match actor public key id %q", verifier.KeyId(), actor.PublicKey.ID)
+	}
+
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode public key PEM for %q", actorID)
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifier.Verify(pubKey, crypto.SHA256); err != nil {
+		return nil, err
+	}
+
+	return actor, nil
+}
+
+// validateActivityActorURL rejects actor URLs `fetchActivityStreamsActor`
+// has no business fetching: anything not `https`, and anything that
+// resolves to a loopback, private, link-local, or otherwise non-public
+// address. Without this, a forged `Follow` activity could name an actor URL
+// pointing back at the App Engine instance's own internal network and use
+// the inbox as an SSRF proxy.
+func validateActivityActorURL(rawURL string) (*url.URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing actor URL %q: %v", rawURL, err)
+	}
+	if parsed.Scheme != "https" {
+		return nil, fmt.Errorf("actor URL %q must use https", rawURL)
+	}
+	host := parsed.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("actor URL %q has no host", rawURL)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving actor host %q: %v", host, err)
+	}
+	for _, ip := range ips {
+		if isDisallowedActorIP(ip) {
+			return nil, fmt.Errorf("actor URL %q resolves to disallowed address %v", rawURL, ip)
+		}
+	}
+
+	return parsed, nil
+}
+
+// isDisallowedActorIP reports whether `ip` is the kind of address an actor
+// URL must never be allowed to resolve to.
+func isDisallowedActorIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast()
+}
+
+func fetchActivityStreamsActor(ctx context.Context, actorID string) (*activityStreamsActor, error) {
+	parsed, err := validateActivityActorURL(actorID)
+	if err != nil {
+		return nil, err
+	}
+
+	client := urlfetch.Client(ctx)
+	req, err := http.NewRequest("GET", parsed.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", activityStreamsContentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching actor %q: %v", actorID, resp.Status)
+	}
+
+	actor := &activityStreamsActor{}
+	if err := json.NewDecoder(resp.Body).Decode(actor); err != nil {
+		return nil, err
+	}
+	return actor, nil
+}
+
+// deliverStatsUpdateActivity POSTs an `Update` activity for `userId` to a
+// single follower's shared inbox. `updateUserStat` enqueues one of these per
+// follower whenever a new Glicko rating is written.
+func deliverStatsUpdateActivity(ctx context.Context, userId string, sharedInbox string) error {
+	log.Infof(ctx, "deliverStatsUpdateActivity(..., %q, %q)", userId, sharedInbox)
+
+	actorURL := fmt.Sprintf("https://%s/User/%s/Actor", appengine.DefaultVersionHostname(ctx), userId)
+	update := map[string]interface{}{
+		"@context": "https://www.w3.org/ns/activitystreams",
+		"type":     "Update",
+		"actor":    actorURL,
+		"object":   actorURL,
+	}
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	client := urlfetch.Client(ctx)
+	resp, err := client.Post(sharedInbox, activityStreamsContentType, bytes.NewReader(payload))
+	if err != nil {
+		log.Errorf(ctx, "Unable to deliver update to %q: %v", sharedInbox, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	log.Infof(ctx, "deliverStatsUpdateActivity(..., %q, %q) *** SUCCESS ***", userId, sharedInbox)
+
+	return nil
+}
+
+// notifyStatsFollowers enqueues delivery of an `Update` activity to every
+// follower of `userId`.
+func notifyStatsFollowers(ctx context.Context, userId string) error {
+	it := datastore.NewQuery(statsFollowerKind).Filter("UserId=", userId).Run(ctx)
+	for {
+		follower := &StatsFollower{}
+		_, err := it.Next(follower)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := deliverStatsUpdateActivityFunc.EnqueueIn(ctx, 0, userId, follower.SharedInbox); err != nil {
+			return err
+		}
+	}
+	return nil
+}
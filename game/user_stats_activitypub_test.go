@@ -0,0 +1,42 @@
+package game
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsDisallowedActorIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+		{"127.0.0.1", true},
+		{"10.0.0.5", true},
+		{"169.254.1.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if ip == nil {
+			t.Fatalf("net.ParseIP(%q) = nil", test.ip)
+		}
+		if got := isDisallowedActorIP(ip); got != test.want {
+			t.Errorf("isDisallowedActorIP(%q) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestValidateActivityActorURL(t *testing.T) {
+	if _, err := validateActivityActorURL("http://example.com/actor"); err == nil {
+		t.Errorf("validateActivityActorURL(http://...) = nil error, want rejection of non-https scheme")
+	}
+	if _, err := validateActivityActorURL("https://"); err == nil {
+		t.Errorf("validateActivityActorURL(https://) = nil error, want rejection of missing host")
+	}
+	if _, err := validateActivityActorURL("not a url at all %"); err == nil {
+		t.Errorf("validateActivityActorURL(malformed) = nil error, want parse error")
+	}
+}
@@ -0,0 +1,282 @@
+package game
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/zond/diplicity/auth"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	. "github.com/zond/goaeoas"
+)
+
+const (
+	// banClusterMaxDepth/banClusterMaxNodes bound the cost of the BFS
+	// `updateUserStat` runs to compute `BanClusterSize`.
+	banClusterMaxDepth = 2
+	banClusterMaxNodes = 200
+)
+
+// banProjection is the subset of `banKind` the ban graph and cluster BFS
+// need, loaded without decoding the rest of the entity.
+type banProjection struct {
+	OwnerIds  []string
+	UserIds   []string
+	CreatedAt time.Time
+}
+
+// UserBanRef is one edge in a user's ban graph, joined against `auth.User`
+// for display.
+type UserBanRef struct {
+	OtherUserId   string
+	OtherUserName string
+	CreatedAt     time.Time
+}
+
+type UserBanRefSlice []UserBanRef
+
+func (s UserBanRefSlice) Item(r Request, cursor *datastore.Cursor, limit int64, name string, desc []string, route string) *Item {
+	refItems := make(List, len(s))
+	for i := range s {
+		refItems[i] = NewItem(s[i]).SetName("user-ban-ref")
+	}
+	refsItem := NewItem(refItems).SetName(name).SetDesc([][]string{
+		desc,
+	}).AddLink(r.NewLink(Link{
+		Rel:   "self",
+		Route: route,
+	}))
+	if cursor != nil {
+		refsItem.AddLink(r.NewLink(Link{
+			Rel:   "next",
+			Route: route,
+			QueryParams: url.Values{
+				"cursor": []string{cursor.String()},
+				"limit":  []string{fmt.Sprint(limit)},
+			},
+		}))
+	}
+	return refsItem
+}
+
+var UserBanGraphResource = &Resource{
+	Load:     loadUserBanGraph,
+	FullPath: "/User/{user_id}/Bans",
+}
+
+type userBanGraph struct {
+	owned        UserBanRefSlice
+	ownedCursor  *datastore.Cursor
+	shared       UserBanRefSlice
+	sharedCursor *datastore.Cursor
+	limit        int64
+}
+
+func (g *userBanGraph) Item(r Request) *Item {
+	ownedItem := g.owned.Item(r, g.ownedCursor, g.limit, "owned", []string{
+		"Users this player has banned.",
+	}, "UserBanGraphOwned")
+	sharedItem := g.shared.Item(r, g.sharedCursor, g.limit, "shared", []string{
+		"Users sharing a ban with this player that they don't own.",
+	}, "UserBanGraphShared")
+	return NewItem(List{ownedItem, sharedItem}).SetName("user-ban-graph").SetDesc([][]string{
+		{"Who this player bans, and who they're banned alongside, for ban-aware matchmaking."},
+	}).AddLink(r.NewLink(Link{
+		Rel:   "self",
+		Route: "UserBanGraph",
+	}))
+}
+
+func loadUserBanGraph(w ResponseWriter, r Request) (*userBanGraph, error) {
+	ctx := appengine.NewContext(r.Req())
+
+	_, ok := r.Values()["user"].(*auth.User)
+	if !ok {
+		return nil, HTTPErr{"unauthorized", 401}
+	}
+
+	userId := r.Vars()["user_id"]
+
+	limit := int64(defaultUserStatsLeaderboardLimit)
+	if limitParam := r.Req().URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.ParseInt(limitParam, 10, 64)
+		if err != nil {
+			return nil, HTTPErr{"limit must be an integer", 400}
+		}
+		limit = parsed
+	}
+	if limit < 1 {
+		limit = defaultUserStatsLeaderboardLimit
+	}
+	if limit > maxUserStatsLeaderboardLimit {
+		limit = maxUserStatsLeaderboardLimit
+	}
+
+	owned, ownedCursor, err := loadUserBanRefs(ctx, r, userId, "OwnerIds=", limit, "owned_cursor", func(ban *banProjection) []string {
+		return otherUserIds(ban.UserIds, userId)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	shared, sharedCursor, err := loadUserBanRefs(ctx, r, userId, "UserIds=", limit, "shared_cursor", func(ban *banProjection) []string {
+		if stringSliceContains(ban.OwnerIds, userId) {
+			return nil
+		}
+		return otherUserIds(ban.OwnerIds, userId)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &userBanGraph{
+		owned:        owned,
+		ownedCursor:  ownedCursor,
+		shared:       shared,
+		sharedCursor: sharedCursor,
+		limit:        limit,
+	}, nil
+}
+
+// loadUserBanRefs scans `banKind` filtered by `filterProp = userId`, and for
+// every matching ban projects the "other" user ids via `otherIds`, joining
+// each one against `auth.User` for display.
+func loadUserBanRefs(ctx context.Context, r Request, userId string, filterProp string, limit int64, cursorParam string, otherIds func(*banProjection) []string) (UserBanRefSlice, *datastore.Cursor, error) {
+	query := datastore.NewQuery(banKind).Filter(filterProp, userId).Limit(int(limit))
+	if cursorString := r.Req().URL.Query().Get(cursorParam); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			return nil, nil, HTTPErr{"cursor is malformed", 400}
+		}
+		query = query.Start(cursor)
+	}
+
+	refs := UserBanRefSlice{}
+	fetched := int64(0)
+	it := query.Run(ctx)
+	for {
+		ban := &banProjection{}
+		_, err := it.Next(ban)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		fetched++
+		for _, otherUserId := range otherIds(ban) {
+			user := &auth.User{}
+			if err := datastore.Get(ctx, auth.UserID(ctx, otherUserId), user); err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, nil, err
+			}
+			refs = append(refs, UserBanRef{
+				OtherUserId:   otherUserId,
+				OtherUserName: user.Name,
+				CreatedAt:     ban.CreatedAt,
+			})
+		}
+	}
+
+	// The page is bounded by how many *entities* the query returned, not by
+	// how many refs came out of `otherIds` (the "shared" list filters whole
+	// entities down to nil when the caller owns them, so a full page can
+	// still produce zero refs while more data remains beyond it).
+	var cursor *datastore.Cursor
+	if fetched == limit {
+		c, err := it.Cursor()
+		if err != nil {
+			return nil, nil, err
+		}
+		cursor = &c
+	}
+
+	return refs, cursor, nil
+}
+
+// otherUserIds returns `ids` with every occurrence of `self` removed.
+func otherUserIds(ids []string, self string) []string {
+	others := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != self {
+			others = append(others, id)
+		}
+	}
+	return others
+}
+
+// usersBannedBy returns the user ids that `userId` bans as an owner.
+func usersBannedBy(ctx context.Context, userId string) ([]string, error) {
+	return banNeighbors(ctx, "OwnerIds=", userId, func(ban *banProjection) []string {
+		return ban.UserIds
+	})
+}
+
+// usersWhoBan returns the user ids that own a ban targeting `userId`.
+func usersWhoBan(ctx context.Context, userId string) ([]string, error) {
+	return banNeighbors(ctx, "UserIds=", userId, func(ban *banProjection) []string {
+		return ban.OwnerIds
+	})
+}
+
+func banNeighbors(ctx context.Context, filterProp string, userId string, otherIds func(*banProjection) []string) ([]string, error) {
+	neighbors := []string{}
+	it := datastore.NewQuery(banKind).Filter(filterProp, userId).Run(ctx)
+	for {
+		ban := &banProjection{}
+		_, err := it.Next(ban)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		neighbors = append(neighbors, otherUserIds(otherIds(ban), userId)...)
+	}
+	return neighbors, nil
+}
+
+// growBanCluster merges `candidates` into `visited`, stopping as soon as
+// `visited` reaches `maxNodes`, split out of `computeBanClusterSize` so the
+// capping rule is unit-testable without a datastore.
+func growBanCluster(visited map[string]bool, candidates []string, maxNodes int) {
+	for _, c := range candidates {
+		if len(visited) >= maxNodes {
+			return
+		}
+		visited[c] = true
+	}
+}
+
+// computeBanClusterSize runs a capped two-hop BFS over the ban graph: first
+// the users `userId` bans, then the users who in turn ban any of those, and
+// returns the size of that reachable set (excluding `userId` itself) so
+// matchmaking code can avoid seeding games whose candidates collapse into
+// one large mutual-avoidance cluster.
+func computeBanClusterSize(ctx context.Context, userId string) (int, error) {
+	visited := map[string]bool{userId: true}
+
+	hop1, err := usersBannedBy(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+	growBanCluster(visited, hop1, banClusterMaxNodes)
+
+	if banClusterMaxDepth > 1 {
+		for _, u := range hop1 {
+			if len(visited) >= banClusterMaxNodes {
+				break
+			}
+			owners, err := usersWhoBan(ctx, u)
+			if err != nil {
+				return 0, err
+			}
+			growBanCluster(visited, owners, banClusterMaxNodes)
+		}
+	}
+
+	return len(visited) - 1, nil
+}
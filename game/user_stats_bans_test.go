@@ -0,0 +1,38 @@
+package game
+
+import (
+	"testing"
+)
+
+func TestOtherUserIds(t *testing.T) {
+	got := otherUserIds([]string{"a", "b", "a", "c"}, "a")
+	want := []string{"b", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("otherUserIds(...) = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("otherUserIds(...)[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGrowBanCluster(t *testing.T) {
+	visited := map[string]bool{"self": true}
+	growBanCluster(visited, []string{"a", "b", "c"}, 3)
+	if len(visited) != 3 {
+		t.Fatalf("growBanCluster stopped at %d nodes, want exactly 3 (cap reached)", len(visited))
+	}
+
+	visited = map[string]bool{"self": true}
+	growBanCluster(visited, []string{"a", "b"}, 10)
+	if len(visited) != 3 {
+		t.Fatalf("growBanCluster(...) = %d nodes, want 3 (no cap hit)", len(visited))
+	}
+
+	visited = map[string]bool{"self": true, "a": true}
+	growBanCluster(visited, []string{"a", "b"}, 10)
+	if len(visited) != 2 {
+		t.Fatalf("growBanCluster re-added an already-visited node: %d nodes, want 2", len(visited))
+	}
+}
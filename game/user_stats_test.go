@@ -0,0 +1,106 @@
+package game
+
+import (
+	"testing"
+)
+
+func TestStringSliceContains(t *testing.T) {
+	tests := []struct {
+		haystack []string
+		needle   string
+		want     bool
+	}{
+		{nil, "a", false},
+		{[]string{}, "a", false},
+		{[]string{"a", "b", "c"}, "b", true},
+		{[]string{"a", "b", "c"}, "d", false},
+	}
+	for _, test := range tests {
+		if got := stringSliceContains(test.haystack, test.needle); got != test.want {
+			t.Errorf("stringSliceContains(%v, %q) = %v, want %v", test.haystack, test.needle, got, test.want)
+		}
+	}
+}
+
+func TestBucketPhaseResultTally(t *testing.T) {
+	tally := &phaseResultUserTally{
+		User:        []string{"alice", "bob"},
+		NMRUsers:    []string{"bob"},
+		ActiveUsers: []string{"alice"},
+		ReadyUsers:  []string{},
+	}
+
+	nmr, active, ready := bucketPhaseResultTally(tally, "alice")
+	if nmr || !active || ready {
+		t.Errorf("bucketPhaseResultTally(..., %q) = (%v, %v, %v), want (false, true, false)", "alice", nmr, active, ready)
+	}
+
+	nmr, active, ready = bucketPhaseResultTally(tally, "bob")
+	if !nmr || active || ready {
+		t.Errorf("bucketPhaseResultTally(..., %q) = (%v, %v, %v), want (true, false, false)", "bob", nmr, active, ready)
+	}
+
+	nmr, active, ready = bucketPhaseResultTally(tally, "carol")
+	if nmr || active || ready {
+		t.Errorf("bucketPhaseResultTally(..., %q) = (%v, %v, %v), want all false", "carol", nmr, active, ready)
+	}
+}
+
+func TestShouldTakeUserStatsSnapshot(t *testing.T) {
+	tests := []struct {
+		name          string
+		hasLast       bool
+		last          *UserStatsSnapshot
+		today         string
+		currentRating float64
+		want          bool
+	}{
+		{
+			name:          "no prior snapshot",
+			hasLast:       false,
+			last:          &UserStatsSnapshot{},
+			today:         "20260730",
+			currentRating: 1500,
+			want:          true,
+		},
+		{
+			name:          "new day",
+			hasLast:       true,
+			last:          &UserStatsSnapshot{Date: "20260729", Glicko: Glicko{Rating: 1500}},
+			today:         "20260730",
+			currentRating: 1500,
+			want:          true,
+		},
+		{
+			name:          "same day, small delta",
+			hasLast:       true,
+			last:          &UserStatsSnapshot{Date: "20260730", Glicko: Glicko{Rating: 1500}},
+			today:         "20260730",
+			currentRating: 1505,
+			want:          false,
+		},
+		{
+			name:          "same day, large delta",
+			hasLast:       true,
+			last:          &UserStatsSnapshot{Date: "20260730", Glicko: Glicko{Rating: 1500}},
+			today:         "20260730",
+			currentRating: 1520,
+			want:          true,
+		},
+		{
+			name:          "same day, large negative delta",
+			hasLast:       true,
+			last:          &UserStatsSnapshot{Date: "20260730", Glicko: Glicko{Rating: 1500}},
+			today:         "20260730",
+			currentRating: 1480,
+			want:          true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := shouldTakeUserStatsSnapshot(test.hasLast, test.last, test.today, test.currentRating); got != test.want {
+				t.Errorf("shouldTakeUserStatsSnapshot(%v, %v, %q, %v) = %v, want %v", test.hasLast, test.last, test.today, test.currentRating, got, test.want)
+			}
+		})
+	}
+}